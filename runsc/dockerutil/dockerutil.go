@@ -0,0 +1,297 @@
+// Copyright 2018 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package dockerutil is a collection of utility functions that simplify
+// working with Docker containers in tests. Containers are started with
+// "docker run" and torn down with "docker rm -f" so each test gets a clean
+// container every time.
+package dockerutil
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"os"
+	"os/exec"
+	"os/signal"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Docker contains the name and the runtime of a container.
+type Docker struct {
+	Name    string
+	Runtime string
+
+	cleanup *cleanupState
+}
+
+// cleanupState guards CleanUp's idempotency. It's held behind a pointer,
+// rather than embedding a sync.Mutex directly in Docker, so that Docker
+// itself stays copyable: every call site holds it by value (MakeDocker
+// returns a Docker, not a *Docker), and go vet's copylocks check would flag
+// copying an embedded Mutex.
+type cleanupState struct {
+	mu        sync.Mutex
+	cleanedUp bool
+}
+
+// MakeDocker sets up the struct for a Docker container using the default
+// runsc runtime, and registers it with the global cleanup tracker so that it
+// is swept up if the test binary is killed before its own deferred CleanUp
+// runs.
+func MakeDocker(namePrefix string) Docker {
+	return MakeDockerWithRuntime(namePrefix, "runsc")
+}
+
+// MakeDockerWithRuntime is like MakeDocker but starts the container under
+// the named Docker runtime (e.g. "runsc-kvm"), allowing a single test to be
+// driven against more than one gVisor platform configuration. See
+// ForEachRuntime.
+func MakeDockerWithRuntime(namePrefix, runtime string) Docker {
+	d := Docker{
+		Name:    fmt.Sprintf("%s-%06d", namePrefix, rand.Int()),
+		Runtime: runtime,
+		cleanup: &cleanupState{},
+	}
+	RegisterCleanup(d.Name)
+	return d
+}
+
+// Run calls 'docker run' with the arguments provided. The image reference
+// (the first argument not starting with "-") is pulled through PullOnce and
+// rewritten to the configured registry mirror, if any, before the container
+// is started.
+func (d *Docker) Run(args ...string) error {
+	args = append([]string{}, args...)
+	if i := imageArgIndex(args); i >= 0 {
+		if err := PullOnce(args[i]); err != nil {
+			return fmt.Errorf("error pulling %q: %v", args[i], err)
+		}
+		args[i] = mirrorImage(args[i])
+	}
+
+	a := []string{"run", "--runtime=" + d.Runtime, "--name", d.Name, "-d"}
+	a = append(a, args...)
+	cmd := exec.Command("docker", a...)
+	return cmd.Run()
+}
+
+// dockerFlagsWithValue are the "docker run" flags, used by this package's
+// call sites, that consume a separate following argument as their value
+// (e.g. "-p 80"), as opposed to boolean flags or the "--flag=value" form.
+// imageArgIndex must skip both tokens for these, or it mistakes the value
+// for the image reference.
+var dockerFlagsWithValue = map[string]bool{
+	"-e": true, "--env": true,
+	"-l": true, "--label": true,
+	"-m": true, "--memory": true,
+	"-p": true, "--publish": true,
+	"-u": true, "--user": true,
+	"-v": true, "--volume": true,
+	"-w": true, "--workdir": true,
+	"--entrypoint": true,
+	"--network":    true,
+}
+
+// imageArgIndex returns the index of the image reference in args, which by
+// convention is the first argument that isn't a flag and isn't consumed as a
+// flag's value. It returns -1 if args contains no such argument.
+func imageArgIndex(args []string) int {
+	skipNext := false
+	for i, arg := range args {
+		if skipNext {
+			skipNext = false
+			continue
+		}
+		if strings.HasPrefix(arg, "-") {
+			skipNext = dockerFlagsWithValue[arg]
+			continue
+		}
+		return i
+	}
+	return -1
+}
+
+// CleanUp kills and deletes the container and removes it from the signal
+// trap's tracker. It is idempotent: every call after the first is a no-op.
+func (d *Docker) CleanUp() error {
+	d.cleanup.mu.Lock()
+	defer d.cleanup.mu.Unlock()
+	if d.cleanup.cleanedUp {
+		return nil
+	}
+	d.cleanup.cleanedUp = true
+	UnregisterCleanup(d.Name)
+
+	cmd := exec.Command("docker", "kill", d.Name)
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("error killing container %q: %v", d.Name, err)
+	}
+	cmd = exec.Command("docker", "rm", "-f", d.Name)
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("error deleting container %q: %v", d.Name, err)
+	}
+	return nil
+}
+
+// FindPort returns the host port that is mapped to 'sandboxPort'.
+func (d *Docker) FindPort(sandboxPort int) (int, error) {
+	format := fmt.Sprintf(`{{ (index (index .NetworkSettings.Ports "%d/tcp") 0).HostPort }}`, sandboxPort)
+	cmd := exec.Command("docker", "inspect", "-f", format, d.Name)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return -1, fmt.Errorf("error retrieving port: %v", err)
+	}
+	port, err := strconv.Atoi(strings.TrimSpace(string(out)))
+	if err != nil {
+		return -1, fmt.Errorf("error parsing port %q: %v", out, err)
+	}
+	return port, nil
+}
+
+// WaitForOutput calls 'docker logs' to check for the given pattern in the
+// container's output within the given timeout, returning an error if that
+// doesn't happen.
+func (d *Docker) WaitForOutput(pattern string, timeout time.Duration) (string, error) {
+	matches, err := d.waitForOutputSubmatch(pattern, timeout)
+	if err != nil {
+		return "", err
+	}
+	if len(matches) == 0 {
+		return "", nil
+	}
+	return matches[0], nil
+}
+
+func (d *Docker) waitForOutputSubmatch(pattern string, timeout time.Duration) ([]string, error) {
+	re := regexp.MustCompile(pattern)
+	var out string
+	start := time.Now()
+	for time.Now().Sub(start) < timeout {
+		var err error
+		out, err = d.logs()
+		if err != nil {
+			return nil, err
+		}
+		if matches := re.FindStringSubmatch(out); matches != nil {
+			return matches, nil
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	return nil, fmt.Errorf("timeout waiting for output %q: %s", pattern, out)
+}
+
+func (d *Docker) logs() (string, error) {
+	cmd := exec.Command("docker", "logs", d.Name)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("error getting logs for container %q: %v", d.Name, err)
+	}
+	return stdout.String() + stderr.String(), nil
+}
+
+// EnsureSupportedDockerVersion checks if correct docker is installed. Docker
+// 17.09 is required for gVisor support.
+func EnsureSupportedDockerVersion() {
+	cmd := exec.Command("docker", "version", "-f", "{{.Server.Version}}")
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error getting docker version: %v\n", err)
+		os.Exit(1)
+	}
+	if version := strings.TrimSpace(string(out)); !strings.Contains(version, "-") && strings.Compare("17.09.0", version) > 0 {
+		fmt.Fprintf(os.Stderr, "Docker version %q not supported. Please install 17.09.0 or greater\n", version)
+		os.Exit(1)
+	}
+}
+
+var (
+	trapOnce    sync.Once
+	trapMu      sync.Mutex
+	tracked     = map[string]struct{}{}
+	signalsSeen int
+)
+
+// RegisterCleanup adds name to the set of containers that the signal trap
+// handler will sweep up if the test binary is killed. It is exported so that
+// ad-hoc containers that are not created through MakeDocker (e.g. the mysql
+// client in TestMysql) are also cleaned up.
+func RegisterCleanup(name string) {
+	installSignalTrap()
+	trapMu.Lock()
+	defer trapMu.Unlock()
+	tracked[name] = struct{}{}
+}
+
+// UnregisterCleanup removes name from the set of containers tracked for
+// signal-triggered cleanup, typically because it has already been cleaned up
+// normally.
+func UnregisterCleanup(name string) {
+	trapMu.Lock()
+	defer trapMu.Unlock()
+	delete(tracked, name)
+}
+
+// installSignalTrap installs a handler for SIGINT/SIGTERM (and SIGQUIT when
+// the DEBUG environment variable is set) that force-removes every tracked
+// container before the process exits. This mirrors Docker's own signal trap
+// so that a Ctrl-C or a Bazel test timeout doesn't leave orphaned containers
+// behind to collide with the next run. It is installed lazily, on the first
+// registered container, so that test binaries that never touch dockerutil
+// don't pay for an unused goroutine.
+func installSignalTrap() {
+	trapOnce.Do(func() {
+		sigs := []os.Signal{syscall.SIGINT, syscall.SIGTERM}
+		if _, debug := os.LookupEnv("DEBUG"); debug {
+			sigs = append(sigs, syscall.SIGQUIT)
+		}
+		ch := make(chan os.Signal, 1)
+		signal.Notify(ch, sigs...)
+		go func() {
+			for range ch {
+				trapMu.Lock()
+				signalsSeen++
+				seen := signalsSeen
+				names := make([]string, 0, len(tracked))
+				for name := range tracked {
+					names = append(names, name)
+				}
+				trapMu.Unlock()
+
+				if seen > 1 {
+					fmt.Fprintln(os.Stderr, "dockerutil: force shutdown")
+					os.Exit(1)
+				}
+
+				// Run cleanup in its own goroutine so the loop above keeps reading
+				// ch: a second signal arriving while "docker rm" is still working
+				// through a long container list must still hit the seen > 1 path
+				// above instead of waiting behind it.
+				go func() {
+					for _, name := range names {
+						exec.Command("docker", "rm", "-f", name).Run()
+					}
+					os.Exit(1)
+				}()
+			}
+		}()
+	})
+}
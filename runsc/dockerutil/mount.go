@@ -0,0 +1,106 @@
+// Copyright 2018 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dockerutil
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// MountOpt configures how MountArg mounts a host path into a container.
+type MountOpt int
+
+const (
+	// ReadOnly mounts the path read-only inside the container.
+	ReadOnly MountOpt = iota
+	// ReadWrite mounts the path read-write inside the container.
+	ReadWrite
+	// RelabelShared appends the SELinux "shared content" (z) relabel flag,
+	// allowing the bind mount to be accessed by multiple containers. Use this
+	// on SELinux-enforcing hosts (RHEL/CentOS/Fedora) where an unlabeled bind
+	// mount otherwise fails with "permission denied".
+	RelabelShared
+	// RelabelPrivate appends the SELinux "private unshared content" (Z)
+	// relabel flag, giving the bind mount a private label usable only by the
+	// container it's mounted into.
+	RelabelPrivate
+)
+
+// MountArg formats the 'docker run' argument to bind mount source at target
+// inside the container. opts must include exactly one of ReadOnly/ReadWrite;
+// RelabelShared or RelabelPrivate may additionally be passed to relabel the
+// mount for SELinux-enforcing hosts.
+func MountArg(source, target string, opts ...MountOpt) string {
+	mode, label := "ro", ""
+	for _, o := range opts {
+		switch o {
+		case ReadOnly:
+			mode = "ro"
+		case ReadWrite:
+			mode = "rw"
+		case RelabelShared:
+			label = ",z"
+		case RelabelPrivate:
+			label = ",Z"
+		}
+	}
+	return fmt.Sprintf("-v=%s:%s:%s%s", source, target, mode, label)
+}
+
+// SELinuxEnabled reports whether the host is running with SELinux enforcing,
+// by reading /sys/fs/selinux/enforce. Tests use this to decide whether to
+// pass RelabelShared/RelabelPrivate to MountArg, so that non-SELinux hosts
+// don't pay for an unnecessary relabel.
+func SELinuxEnabled() bool {
+	b, err := ioutil.ReadFile("/sys/fs/selinux/enforce")
+	if err != nil {
+		return false
+	}
+	return strings.TrimSpace(string(b)) == "1"
+}
+
+// LinkArg formats the 'docker run' argument that links to another container,
+// making it reachable at the given name.
+func LinkArg(source *Docker, target string) string {
+	return fmt.Sprintf("--link=%s:%s", source.Name, target)
+}
+
+// PrepareFiles copies the given files into a fresh temporary directory so
+// that it can be bind mounted into a container with MountArg. It returns the
+// directory and a function that removes it.
+func PrepareFiles(paths ...string) (string, func(), error) {
+	dir, err := ioutil.TempDir("", "docker-test")
+	if err != nil {
+		return "", nil, fmt.Errorf("error creating temporary directory: %v", err)
+	}
+	cleanup := func() { os.RemoveAll(dir) }
+
+	for _, p := range paths {
+		contents, err := ioutil.ReadFile(p)
+		if err != nil {
+			cleanup()
+			return "", nil, fmt.Errorf("error reading %q: %v", p, err)
+		}
+		dst := filepath.Join(dir, filepath.Base(p))
+		if err := ioutil.WriteFile(dst, contents, 0644); err != nil {
+			cleanup()
+			return "", nil, fmt.Errorf("error writing %q: %v", dst, err)
+		}
+	}
+	return dir, cleanup, nil
+}
@@ -0,0 +1,112 @@
+// Copyright 2018 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dockerutil
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+var registryMirror = flag.String("registry-mirror", "", "host:port of a registry mirror images are pulled through, also settable via DOCKER_REGISTRY_MIRROR")
+var imageCacheDir = flag.String("image-cache", "", "directory of pre-built image .tar files to 'docker load' when the daemon doesn't already have the requested image")
+
+// mirrorImage rewrites image to pull through the configured registry mirror,
+// if one is set via the -registry-mirror flag or the DOCKER_REGISTRY_MIRROR
+// environment variable. Otherwise image is returned unchanged.
+func mirrorImage(image string) string {
+	mirror := *registryMirror
+	if mirror == "" {
+		mirror = os.Getenv("DOCKER_REGISTRY_MIRROR")
+	}
+	if mirror == "" {
+		return image
+	}
+	return mirror + "/" + image
+}
+
+// pullResult caches the outcome of pulling a single image so that concurrent
+// tests requesting the same image only pay the network cost once.
+type pullResult struct {
+	once sync.Once
+	err  error
+}
+
+var inFlightPulls sync.Map // image -> *pullResult
+
+// PullOnce ensures that image is available to the Docker daemon, either by
+// loading it from the local image cache or by pulling it through the
+// registry mirror, de-duplicating concurrent requests for the same image
+// across parallel tests.
+func PullOnce(image string) error {
+	v, _ := inFlightPulls.LoadOrStore(image, &pullResult{})
+	pr := v.(*pullResult)
+	pr.once.Do(func() {
+		pr.err = pullImage(image)
+	})
+	return pr.err
+}
+
+func pullImage(image string) error {
+	if *imageCacheDir != "" {
+		loaded, err := loadFromCache(image)
+		if err != nil {
+			return err
+		}
+		if loaded {
+			return nil
+		}
+	}
+	cmd := exec.Command("docker", "pull", mirrorImage(image))
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("docker pull %q: %v: %s", image, err, out)
+	}
+	return nil
+}
+
+// loadFromCache docker-loads the tarball for image out of -image-cache, if
+// the daemon doesn't already have the image and a matching tarball exists.
+// It reports whether the image is now present in the daemon.
+func loadFromCache(image string) (bool, error) {
+	if haveImage(image) {
+		return true, nil
+	}
+	tar := filepath.Join(*imageCacheDir, cacheFileName(image))
+	if _, err := os.Stat(tar); err != nil {
+		return false, nil
+	}
+	cmd := exec.Command("docker", "load", "-i", tar)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return false, fmt.Errorf("docker load %q: %v: %s", tar, err, out)
+	}
+	return true, nil
+}
+
+func haveImage(image string) bool {
+	return exec.Command("docker", "image", "inspect", image).Run() == nil
+}
+
+// cacheFileName maps an image reference to the tarball name it's expected
+// under in the cache directory, e.g. "gvisor.dev/images/httpd" becomes
+// "gvisor.dev_images_httpd.tar".
+func cacheFileName(image string) string {
+	replacer := strings.NewReplacer("/", "_", ":", "_")
+	return replacer.Replace(image) + ".tar"
+}
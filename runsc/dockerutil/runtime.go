@@ -0,0 +1,51 @@
+// Copyright 2018 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dockerutil
+
+import (
+	"flag"
+	"strings"
+	"testing"
+)
+
+var runtimes = flag.String("runtimes", "runsc", "comma-separated list of Docker runtimes to run each image test against")
+
+// Runtimes returns the set of runtimes a single 'go test' invocation should
+// exercise, as configured by the -runtimes flag.
+func Runtimes() []string {
+	return strings.Split(*runtimes, ",")
+}
+
+// ForEachRuntime runs fn as a subtest once per runtime named in the
+// -runtimes flag, so that a single Test* function can be gated on every
+// configured gVisor platform. fn is expected to create its own containers
+// with MakeDockerWithRuntime(name, runtime).
+func ForEachRuntime(t *testing.T, fn func(t *testing.T, runtime string)) {
+	for _, runtime := range Runtimes() {
+		runtime := runtime
+		t.Run(runtime, func(t *testing.T) {
+			fn(t, runtime)
+		})
+	}
+}
+
+// SkipIfRuntime skips the current test if it is running as the named
+// runtime's ForEachRuntime subtest, for tests that are known to be
+// incompatible with a given platform.
+func SkipIfRuntime(t *testing.T, runtime string) {
+	if strings.HasSuffix(t.Name(), "/"+runtime) {
+		t.Skipf("test is not supported under runtime %q", runtime)
+	}
+}
@@ -38,15 +38,17 @@ import (
 )
 
 func TestHelloWorld(t *testing.T) {
-	d := dockerutil.MakeDocker("hello-test")
-	if err := d.Run("hello-world"); err != nil {
-		t.Fatalf("docker run failed: %v", err)
-	}
-	defer d.CleanUp()
+	dockerutil.ForEachRuntime(t, func(t *testing.T, runtime string) {
+		d := dockerutil.MakeDockerWithRuntime("hello-test", runtime)
+		if err := d.Run("hello-world"); err != nil {
+			t.Fatalf("docker run failed: %v", err)
+		}
+		defer d.CleanUp()
 
-	if _, err := d.WaitForOutput("Hello from Docker!", 5*time.Second); err != nil {
-		t.Fatalf("docker didn't say hello: %v", err)
-	}
+		if _, err := d.WaitForOutput("Hello from Docker!", 5*time.Second); err != nil {
+			t.Fatalf("docker didn't say hello: %v", err)
+		}
+	})
 }
 
 func runHTTPRequest(port int) error {
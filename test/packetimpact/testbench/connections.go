@@ -21,6 +21,7 @@ import (
 	"fmt"
 	"math/rand"
 	"net"
+	"sync"
 	"testing"
 	"time"
 
@@ -34,6 +35,8 @@ import (
 
 var localIPv4 = flag.String("local_ipv4", "", "local IPv4 address for test packets")
 var remoteIPv4 = flag.String("remote_ipv4", "", "remote IPv4 address for test packets")
+var localIPv6 = flag.String("local_ipv6", "", "local IPv6 address for test packets")
+var remoteIPv6 = flag.String("remote_ipv6", "", "remote IPv6 address for test packets")
 var localMAC = flag.String("local_mac", "", "local mac address for test packets")
 var remoteMAC = flag.String("remote_mac", "", "remote mac address for test packets")
 
@@ -187,6 +190,52 @@ func (s *ipv4State) close() error {
 	return nil
 }
 
+// ipv6State maintains state about an IPv6 connection.
+type ipv6State struct {
+	out, in IPv6
+}
+
+// newIPv6State creates a new ipv6State.
+func newIPv6State(out, in IPv6) (*ipv6State, error) {
+	lIP := tcpip.Address(net.ParseIP(*localIPv6).To16())
+	rIP := tcpip.Address(net.ParseIP(*remoteIPv6).To16())
+	s := ipv6State{
+		out: IPv6{SrcAddr: &lIP, DstAddr: &rIP},
+		in:  IPv6{SrcAddr: &rIP, DstAddr: &lIP},
+	}
+	if err := s.out.merge(&out); err != nil {
+		return nil, err
+	}
+	if err := s.in.merge(&in); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// outgoing returns an outgoing layer to be sent in a frame.
+func (s *ipv6State) outgoing() Layer {
+	return &s.out
+}
+
+func (s *ipv6State) incoming(Layer) Layer {
+	return deepcopy.Copy(&s.in).(Layer)
+}
+
+func (*ipv6State) sent(Layer) error {
+	// Nothing to do.
+	return nil
+}
+
+func (*ipv6State) received(Layer) error {
+	// Nothing to do.
+	return nil
+}
+
+// Close cleans up any resources held.
+func (s *ipv6State) close() error {
+	return nil
+}
+
 // tcpState maintains state about a TCP connection.
 type tcpState struct {
 	out, in                   TCP
@@ -351,6 +400,35 @@ type Connection struct {
 	injector    Injector
 	sniffer     Sniffer
 	t           *testing.T
+
+	pcapOnce sync.Once
+	pcap     *pcapWriter
+
+	middleboxes []Middlebox
+
+	mtu         int
+	reassembler reassembler
+}
+
+// AddMiddlebox installs m in the connection's send/receive path. Outbound
+// frames are passed through every installed Middlebox, in the order they
+// were added, before being sent; inbound frames are passed through in the
+// same order before being matched against expectations.
+func (conn *Connection) AddMiddlebox(m Middlebox) {
+	conn.middleboxes = append(conn.middleboxes, m)
+}
+
+// pcapWriterForTest lazily creates, on first use, the PCAP-NG capture for
+// this connection's test if -testbench_pcap is set.
+func (conn *Connection) pcapWriterForTest() *pcapWriter {
+	conn.pcapOnce.Do(func() {
+		w, err := newPCAPWriter(conn.t.Name())
+		if err != nil {
+			conn.t.Fatalf("can't create pcap capture: %s", err)
+		}
+		conn.pcap = w
+	})
+	return conn.pcap
 }
 
 // Returns the default incoming frame against which to match. If received is
@@ -373,7 +451,7 @@ func (conn *Connection) incoming(received Layers) Layers {
 
 // Close cleans up any resources held.
 func (conn *Connection) Close() {
-	errs := multierr.Combine(conn.sniffer.close(), conn.injector.close())
+	errs := multierr.Combine(conn.sniffer.close(), conn.injector.close(), conn.pcap.Close())
 	for _, s := range conn.layerStates {
 		if err := s.close(); err != nil {
 			errs = multierr.Append(errs, fmt.Errorf("unable to close %v: %s", s, err))
@@ -400,11 +478,27 @@ func (conn *Connection) CreateFrame(layer Layer, additionalLayers ...Layer) Laye
 
 // SendFrame sends a frame on the wire and updates the state of all layers.
 func (conn *Connection) SendFrame(frame Layers) {
+	for _, mb := range conn.middleboxes {
+		frame = mb.Outbound(frame)
+		if frame == nil {
+			// A Middlebox (e.g. a NAT that doesn't recognize the flow) dropped
+			// the frame: nothing reaches the wire and no layer state advances.
+			return
+		}
+	}
+
 	outBytes, err := frame.toBytes()
 	if err != nil {
 		conn.t.Fatalf("can't build outgoing TCP packet: %s", err)
 	}
-	conn.injector.Send(outBytes)
+	frags := [][]byte{outBytes}
+	if conn.mtu > 0 {
+		frags = fragmentIPv4(outBytes, conn.mtu)
+	}
+	for _, frag := range frags {
+		conn.injector.Send(frag)
+		conn.pcapWriterForTest().writeOutbound(frag)
+	}
 
 	// frame might have nil values where the caller wanted to use default values.
 	// sentFrame will have no nil values in it because it comes from parsing the
@@ -426,16 +520,46 @@ func (conn *Connection) Send(layer Layer, additionalLayers ...Layer) {
 
 // recvFrame gets the next successfully parsed frame (of type Layers) within the
 // timeout provided. If no parsable frame arrives before the timeout, it returns
-// nil.
+// nil. A frame that an installed Middlebox drops (e.g. a NAT filtering an
+// unsolicited flow) doesn't count as "arrived"; recvFrame keeps listening
+// until the timeout is exhausted.
+//
+// This still parses with the hand-rolled parse chain below, not gopacket's
+// DecodingLayerParser. An attempt to switch to it was reverted: the adapter
+// functions returned an unlinked Layers slice (no setNext/setPrev), which
+// silently broke tcpState.received's remoteSeqNum tracking and dropped
+// Window/TTL/Checksum/ICMP payload fields that tests assert on. Re-adopting
+// DecodingLayerParser needs a decoder that builds the same linked chain
+// parse does, not just a faithful per-layer field mapping; that is not done
+// here.
 func (conn *Connection) recvFrame(timeout time.Duration) Layers {
-	if timeout <= 0 {
-		return nil
-	}
-	b := conn.sniffer.Recv(timeout)
-	if b == nil {
-		return nil
+	deadline := time.Now().Add(timeout)
+	for {
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return nil
+		}
+		b := conn.sniffer.Recv(remaining)
+		if b == nil {
+			return nil
+		}
+		conn.pcapWriterForTest().writeInbound(b)
+		b = conn.reassembler.reassemble(b)
+		if b == nil {
+			continue // A fragment landed, but the datagram isn't complete yet.
+		}
+		frame := parse(parseEther, b)
+		for _, mb := range conn.middleboxes {
+			if frame == nil {
+				break
+			}
+			frame = mb.Inbound(frame)
+		}
+		if frame == nil {
+			continue
+		}
+		return frame
 	}
-	return parse(parseEther, b)
 }
 
 // LayersError stores the Layers that we got and the Layers that we wanted to
@@ -629,3 +753,130 @@ func NewUDPIPv4(t *testing.T, outgoingUDP, incomingUDP UDP) Connection {
 		t:           t,
 	}
 }
+
+// TCPIPv6 maintains the state for all the layers in a TCP/IPv6 connection.
+type TCPIPv6 Connection
+
+// NewTCPIPv6 creates a new TCPIPv6 connection with reasonable defaults.
+func NewTCPIPv6(t *testing.T, outgoingTCP, incomingTCP TCP) TCPIPv6 {
+	etherState, err := newEtherState(Ether{}, Ether{})
+	if err != nil {
+		t.Fatalf("can't make etherState: %s", err)
+	}
+	ipv6State, err := newIPv6State(IPv6{}, IPv6{})
+	if err != nil {
+		t.Fatalf("can't make ipv6State: %s", err)
+	}
+	tcpState, err := newTCPState(outgoingTCP, incomingTCP)
+	if err != nil {
+		t.Fatalf("can't make tcpState: %s", err)
+	}
+	injector, err := NewInjector(t)
+	if err != nil {
+		t.Fatalf("can't make injector: %s", err)
+	}
+	sniffer, err := NewSniffer(t)
+	if err != nil {
+		t.Fatalf("can't make sniffer: %s", err)
+	}
+
+	return TCPIPv6{
+		layerStates: []layerState{etherState, ipv6State, tcpState},
+		injector:    injector,
+		sniffer:     sniffer,
+		t:           t,
+	}
+}
+
+// Handshake performs a TCP 3-way handshake. The input Connection should have a
+// final TCP Layer.
+func (conn *TCPIPv6) Handshake() {
+	// Send the SYN.
+	conn.Send(TCP{Flags: Uint8(header.TCPFlagSyn)})
+
+	// Wait for the SYN-ACK.
+	synAck, err := conn.Expect(TCP{Flags: Uint8(header.TCPFlagSyn | header.TCPFlagAck)}, time.Second)
+	if synAck == nil {
+		conn.t.Fatalf("didn't get synack during handshake: %s", err)
+	}
+	conn.layerStates[len(conn.layerStates)-1].(*tcpState).synAck = synAck
+
+	// Send an ACK.
+	conn.Send(TCP{Flags: Uint8(header.TCPFlagAck)})
+}
+
+// ExpectData is a convenient method that expects a Layer and the Layer after
+// it. If it doens't arrive in time, it returns nil.
+func (conn *TCPIPv6) ExpectData(tcp *TCP, payload *Payload, timeout time.Duration) (Layers, error) {
+	expected := make([]Layer, len(conn.layerStates))
+	expected[len(expected)-1] = tcp
+	if payload != nil {
+		expected = append(expected, payload)
+	}
+	return (*Connection)(conn).ExpectFrame(expected, timeout)
+}
+
+// Send a packet with reasonable defaults. Potentially override the TCP layer in
+// the connection with the provided layer and add additionLayers.
+func (conn *TCPIPv6) Send(tcp TCP, additionalLayers ...Layer) {
+	(*Connection)(conn).Send(&tcp, additionalLayers...)
+}
+
+// Close to clean up any resources held.
+func (conn *TCPIPv6) Close() {
+	(*Connection)(conn).Close()
+}
+
+// Expect a frame with the TCP layer matching the provided TCP within the
+// timeout specified. If it doesn't arrive in time, it returns nil.
+func (conn *TCPIPv6) Expect(tcp TCP, timeout time.Duration) (*TCP, error) {
+	layer, err := (*Connection)(conn).Expect(&tcp, timeout)
+	if layer == nil {
+		return nil, err
+	}
+	gotTCP, ok := layer.(*TCP)
+	if !ok {
+		conn.t.Fatalf("expected %s to be TCP", layer)
+	}
+	return gotTCP, err
+}
+
+// RemoteSeqNum returns the next expected sequence number from the DUT.
+func (conn *TCPIPv6) RemoteSeqNum() *seqnum.Value {
+	state, ok := conn.layerStates[len(conn.layerStates)-1].(*tcpState)
+	if !ok {
+		conn.t.Fatalf("expected final state of %v to be tcpState", conn.layerStates)
+	}
+	return state.remoteSeqNum
+}
+
+// NewUDPIPv6 creates a new UDPIPv6 connection with reasonable defaults.
+func NewUDPIPv6(t *testing.T, outgoingUDP, incomingUDP UDP) Connection {
+	etherState, err := newEtherState(Ether{}, Ether{})
+	if err != nil {
+		t.Fatalf("can't make etherState: %s", err)
+	}
+	ipv6State, err := newIPv6State(IPv6{}, IPv6{})
+	if err != nil {
+		t.Fatalf("can't make ipv6State: %s", err)
+	}
+	udpState, err := newUDPState(outgoingUDP, incomingUDP)
+	if err != nil {
+		t.Fatalf("can't make udpState: %s", err)
+	}
+	injector, err := NewInjector(t)
+	if err != nil {
+		t.Fatalf("can't make injector: %s", err)
+	}
+	sniffer, err := NewSniffer(t)
+	if err != nil {
+		t.Fatalf("can't make sniffer: %s", err)
+	}
+
+	return Connection{
+		layerStates: []layerState{etherState, ipv6State, udpState},
+		injector:    injector,
+		sniffer:     sniffer,
+		t:           t,
+	}
+}
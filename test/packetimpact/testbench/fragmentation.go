@@ -0,0 +1,290 @@
+// Copyright 2020 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package testbench
+
+import (
+	"encoding/binary"
+	"sync"
+	"time"
+)
+
+// etherHeaderLen is the length of the Ethernet II header this testbench
+// always sends: 2 MAC addresses plus an EtherType.
+const etherHeaderLen = 14
+
+// fragReassemblyTimeout bounds how long a reassembler holds onto fragments
+// of a datagram that never completes, mirroring the "don't hold forever" rule
+// real IP stacks apply (e.g. 60s in Linux).
+const fragReassemblyTimeout = 60 * time.Second
+
+// SetMTU configures automatic IPv4 fragmentation of outgoing frames whose IP
+// packet would exceed mtu bytes. A zero mtu (the default) disables
+// fragmentation entirely. It has no effect on reassembly of incoming
+// fragments, which SetReassembly controls.
+func (conn *Connection) SetMTU(mtu int) {
+	conn.mtu = mtu
+}
+
+// SetReassembly toggles whether incoming IPv4 fragments are transparently
+// reassembled before being matched against expectations. It defaults to
+// true. Tests that want to exercise the DUT's own fragmentation behavior
+// should disable it so ExpectFrame sees the raw fragments.
+func (conn *Connection) SetReassembly(enabled bool) {
+	conn.reassembler.disabled = !enabled
+}
+
+// fragKey identifies the datagram a fragment belongs to, per RFC 791 6.3:
+// source, destination, protocol, and identification.
+type fragKey struct {
+	srcAddr, dstAddr string
+	proto            uint8
+	id               uint16
+}
+
+// fragEntry holds the fragments seen so far for one datagram.
+type fragEntry struct {
+	// pieces maps a fragment's offset (in bytes, from the IP payload start)
+	// to the payload bytes it carried.
+	pieces map[int][]byte
+	// finalLen is the total payload length once the terminal fragment (the
+	// one without the More Fragments flag) has been seen, else -1.
+	finalLen int
+	created  time.Time
+}
+
+// reassembler buffers and reassembles incoming IPv4 fragments for a single
+// Connection. The zero value has reassembly enabled.
+type reassembler struct {
+	disabled bool
+
+	mu      sync.Mutex
+	entries map[fragKey]*fragEntry
+}
+
+// reassemble feeds a raw Ethernet frame b through fragment reassembly. If b
+// doesn't carry an IPv4 fragment (MF flag or nonzero fragment offset), or
+// reassembly is disabled, it's returned unchanged. If b completes a
+// datagram, the full reassembled frame is returned. Otherwise nil is
+// returned and b's payload is held for a later call, unless it overlaps a
+// fragment already held, in which case it is discarded.
+func (r *reassembler) reassemble(b []byte) []byte {
+	if r.disabled {
+		return b
+	}
+	key, offset, flags, payload, ok := parseIPv4Fragment(b)
+	if !ok {
+		return b // Not a fragmented IPv4 packet; nothing to do.
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.entries == nil {
+		r.entries = make(map[fragKey]*fragEntry)
+	}
+	r.expireLocked()
+
+	e, ok := r.entries[key]
+	if !ok {
+		e = &fragEntry{pieces: make(map[int][]byte), finalLen: -1, created: time.Now()}
+		r.entries[key] = e
+	}
+
+	// Reject fragments that overlap a piece we already hold; RFC 5722 makes
+	// this mandatory for IPv6 and it's widely applied to IPv4 reassembly too
+	// to avoid reassembly ambiguity attacks.
+	for existingOffset, existing := range e.pieces {
+		if overlaps(offset, len(payload), existingOffset, len(existing)) {
+			return nil
+		}
+	}
+	e.pieces[offset] = payload
+	if flags&ipv4FlagMoreFragments == 0 {
+		e.finalLen = offset + len(payload)
+	}
+
+	full, ok := e.assemble()
+	if !ok {
+		return nil
+	}
+	delete(r.entries, key)
+	return rebuildUnfragmented(b, full)
+}
+
+func overlaps(aOff, aLen, bOff, bLen int) bool {
+	return aOff < bOff+bLen && bOff < aOff+aLen
+}
+
+// assemble returns the full reassembled payload if every byte from 0 to
+// finalLen is covered by a piece, with ok=false otherwise.
+func (e *fragEntry) assemble() ([]byte, bool) {
+	if e.finalLen < 0 {
+		return nil, false
+	}
+	full := make([]byte, e.finalLen)
+	covered := make([]bool, e.finalLen)
+	for offset, piece := range e.pieces {
+		for i, b := range piece {
+			if offset+i >= e.finalLen {
+				return nil, false // A piece extends past the declared end.
+			}
+			full[offset+i] = b
+			covered[offset+i] = true
+		}
+	}
+	for _, c := range covered {
+		if !c {
+			return nil, false
+		}
+	}
+	return full, true
+}
+
+func (r *reassembler) expireLocked() {
+	cutoff := time.Now().Add(-fragReassemblyTimeout)
+	for key, e := range r.entries {
+		if e.created.Before(cutoff) {
+			delete(r.entries, key)
+		}
+	}
+}
+
+const (
+	ipv4FlagMoreFragments = 0x1
+
+	// etherTypeIPv4 is the EtherType value identifying an IPv4 payload, at
+	// bytes 12-13 of an Ethernet II header.
+	etherTypeIPv4 = 0x0800
+)
+
+// etherTypeIs reports whether b is an Ethernet II frame carrying the given
+// EtherType.
+func etherTypeIs(b []byte, etherType uint16) bool {
+	return len(b) >= etherHeaderLen && binary.BigEndian.Uint16(b[12:14]) == etherType
+}
+
+// parseIPv4Fragment extracts the fragment identity, byte offset, flags, and
+// payload from an Ethernet+IPv4 frame. ok is false if b isn't long enough to
+// be an IPv4 packet, isn't EtherType IPv4 (e.g. IPv6 or ARP), or carries no
+// fragmentation (offset 0 and MF unset), since such a packet needs no
+// reassembly.
+func parseIPv4Fragment(b []byte) (key fragKey, offset int, flags uint8, payload []byte, ok bool) {
+	const minIPv4Header = 20
+	if !etherTypeIs(b, etherTypeIPv4) || len(b) < etherHeaderLen+minIPv4Header {
+		return key, 0, 0, nil, false
+	}
+	ip := b[etherHeaderLen:]
+	ihl := int(ip[0]&0x0f) * 4
+	if ihl < minIPv4Header || len(ip) < ihl {
+		return key, 0, 0, nil, false
+	}
+	flagsAndOffset := binary.BigEndian.Uint16(ip[6:8])
+	flags = uint8(flagsAndOffset >> 13)
+	fragOffsetBytes := int(flagsAndOffset&0x1fff) * 8
+	if fragOffsetBytes == 0 && flags&ipv4FlagMoreFragments == 0 {
+		return key, 0, 0, nil, false // Unfragmented.
+	}
+	totalLen := int(binary.BigEndian.Uint16(ip[2:4]))
+	if totalLen > len(ip) {
+		totalLen = len(ip)
+	}
+	key = fragKey{
+		srcAddr: string(ip[12:16]),
+		dstAddr: string(ip[16:20]),
+		proto:   ip[9],
+		id:      binary.BigEndian.Uint16(ip[4:6]),
+	}
+	return key, fragOffsetBytes, flags, append([]byte(nil), ip[ihl:totalLen]...), true
+}
+
+// rebuildUnfragmented builds a canonical, unfragmented Ethernet+IPv4 frame
+// from one fragment's Ethernet+IPv4 header (any fragment will do, since they
+// share the same header fields aside from length/flags/offset) and the fully
+// reassembled payload.
+func rebuildUnfragmented(fragment []byte, payload []byte) []byte {
+	ihl := int(fragment[etherHeaderLen]&0x0f) * 4
+	headerEnd := etherHeaderLen + ihl
+	out := append([]byte(nil), fragment[:headerEnd]...)
+	out = append(out, payload...)
+
+	ip := out[etherHeaderLen:]
+	binary.BigEndian.PutUint16(ip[2:4], uint16(ihl+len(payload)))
+	ip[6], ip[7] = 0, 0 // Clear flags and fragment offset: this is fragment 0 of 1.
+	ip[10], ip[11] = 0, 0
+	binary.BigEndian.PutUint16(ip[10:12], ipv4HeaderChecksum(ip[:ihl]))
+	return out
+}
+
+// ipv4HeaderChecksum computes the Internet checksum (RFC 1071) of an IPv4
+// header with the checksum field already zeroed.
+func ipv4HeaderChecksum(header []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(header); i += 2 {
+		sum += uint32(header[i])<<8 | uint32(header[i+1])
+	}
+	if len(header)%2 == 1 {
+		sum += uint32(header[len(header)-1]) << 8
+	}
+	for sum>>16 != 0 {
+		sum = sum&0xffff + sum>>16
+	}
+	return ^uint16(sum)
+}
+
+// fragmentIPv4 splits an Ethernet+IPv4 frame into a sequence of
+// Ethernet+IPv4 fragments, each at most mtu bytes of IP packet, if the
+// IP packet exceeds mtu. If it doesn't, or b isn't a well-formed
+// IPv4 packet (including any non-IPv4 EtherType, e.g. IPv6 or ARP), b is
+// returned as the only element.
+func fragmentIPv4(b []byte, mtu int) [][]byte {
+	const minIPv4Header = 20
+	if !etherTypeIs(b, etherTypeIPv4) || len(b) < etherHeaderLen+minIPv4Header {
+		return [][]byte{b}
+	}
+	ip := b[etherHeaderLen:]
+	ihl := int(ip[0]&0x0f) * 4
+	if ihl < minIPv4Header || len(ip) < ihl || len(ip) <= mtu {
+		return [][]byte{b}
+	}
+
+	payload := ip[ihl:]
+	maxPerFrag := ((mtu - ihl) / 8) * 8
+	if maxPerFrag <= 0 {
+		return [][]byte{b} // mtu too small to make progress; leave unfragmented.
+	}
+
+	var frags [][]byte
+	for offset := 0; offset < len(payload); offset += maxPerFrag {
+		end := offset + maxPerFrag
+		last := end >= len(payload)
+		if last {
+			end = len(payload)
+		}
+
+		frag := append([]byte(nil), b[:etherHeaderLen+ihl]...)
+		frag = append(frag, payload[offset:end]...)
+		fragIP := frag[etherHeaderLen:]
+		binary.BigEndian.PutUint16(fragIP[2:4], uint16(ihl+end-offset))
+		flagsAndOffset := uint16(offset / 8)
+		if !last {
+			flagsAndOffset |= ipv4FlagMoreFragments << 13
+		}
+		binary.BigEndian.PutUint16(fragIP[6:8], flagsAndOffset)
+		fragIP[10], fragIP[11] = 0, 0
+		binary.BigEndian.PutUint16(fragIP[10:12], ipv4HeaderChecksum(fragIP[:ihl]))
+
+		frags = append(frags, frag)
+	}
+	return frags
+}
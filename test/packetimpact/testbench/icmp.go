@@ -0,0 +1,316 @@
+// Copyright 2020 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package testbench
+
+import (
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/mohae/deepcopy"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+)
+
+// icmpv4State maintains state about an ICMPv4 flow, identified by an echo
+// identifier analogous to the port tcpState/udpState track, plus the echo
+// sequence number of the most recent request so a reply can be matched to
+// it rather than to any earlier, still-outstanding request.
+type icmpv4State struct {
+	out, in  ICMPv4
+	sequence uint16
+}
+
+// newICMPv4State creates a new icmpv4State.
+func newICMPv4State(out, in ICMPv4) (*icmpv4State, error) {
+	ident := Uint16(uint16(rand.Intn(1 << 16)))
+	s := icmpv4State{
+		out: ICMPv4{Ident: ident},
+		in:  ICMPv4{Ident: ident},
+	}
+	if err := s.out.merge(&out); err != nil {
+		return nil, err
+	}
+	if err := s.in.merge(&in); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// nextSequence advances to the next echo sequence number and records it on
+// both the outgoing template and the incoming matcher, so the next Ping's
+// request carries it and only a reply carrying the same sequence matches.
+func (s *icmpv4State) nextSequence() {
+	s.sequence++
+	seq := Uint16(s.sequence)
+	s.out.Sequence = seq
+	s.in.Sequence = seq
+}
+
+// outgoing returns an outgoing layer to be sent in a frame.
+func (s *icmpv4State) outgoing() Layer {
+	return &s.out
+}
+
+func (s *icmpv4State) incoming(Layer) Layer {
+	return deepcopy.Copy(&s.in).(Layer)
+}
+
+func (*icmpv4State) sent(Layer) error {
+	// Nothing to do.
+	return nil
+}
+
+func (*icmpv4State) received(Layer) error {
+	// Nothing to do.
+	return nil
+}
+
+// Close cleans up any resources held.
+func (s *icmpv4State) close() error {
+	return nil
+}
+
+// icmpv6State maintains state about an ICMPv6 flow, identified by an echo
+// identifier analogous to the port tcpState/udpState track, plus the echo
+// sequence number of the most recent request so a reply can be matched to
+// it rather than to any earlier, still-outstanding request.
+type icmpv6State struct {
+	out, in  ICMPv6
+	sequence uint16
+}
+
+// newICMPv6State creates a new icmpv6State.
+func newICMPv6State(out, in ICMPv6) (*icmpv6State, error) {
+	ident := Uint16(uint16(rand.Intn(1 << 16)))
+	s := icmpv6State{
+		out: ICMPv6{Ident: ident},
+		in:  ICMPv6{Ident: ident},
+	}
+	if err := s.out.merge(&out); err != nil {
+		return nil, err
+	}
+	if err := s.in.merge(&in); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// nextSequence advances to the next echo sequence number and records it on
+// both the outgoing template and the incoming matcher, so the next Ping's
+// request carries it and only a reply carrying the same sequence matches.
+func (s *icmpv6State) nextSequence() {
+	s.sequence++
+	seq := Uint16(s.sequence)
+	s.out.Sequence = seq
+	s.in.Sequence = seq
+}
+
+// outgoing returns an outgoing layer to be sent in a frame.
+func (s *icmpv6State) outgoing() Layer {
+	return &s.out
+}
+
+func (s *icmpv6State) incoming(Layer) Layer {
+	return deepcopy.Copy(&s.in).(Layer)
+}
+
+func (*icmpv6State) sent(Layer) error {
+	// Nothing to do.
+	return nil
+}
+
+func (*icmpv6State) received(Layer) error {
+	// Nothing to do.
+	return nil
+}
+
+// Close cleans up any resources held.
+func (s *icmpv6State) close() error {
+	return nil
+}
+
+// ICMPv4Conn maintains the state for all the layers in an ICMPv4 flow over
+// IPv4.
+type ICMPv4Conn Connection
+
+// NewICMPv4 creates a new ICMPv4Conn connection with reasonable defaults.
+func NewICMPv4(t *testing.T, outgoing, incoming ICMPv4) ICMPv4Conn {
+	etherState, err := newEtherState(Ether{}, Ether{})
+	if err != nil {
+		t.Fatalf("can't make etherState: %s", err)
+	}
+	ipv4State, err := newIPv4State(IPv4{}, IPv4{})
+	if err != nil {
+		t.Fatalf("can't make ipv4State: %s", err)
+	}
+	icmpState, err := newICMPv4State(outgoing, incoming)
+	if err != nil {
+		t.Fatalf("can't make icmpv4State: %s", err)
+	}
+	injector, err := NewInjector(t)
+	if err != nil {
+		t.Fatalf("can't make injector: %s", err)
+	}
+	sniffer, err := NewSniffer(t)
+	if err != nil {
+		t.Fatalf("can't make sniffer: %s", err)
+	}
+
+	return ICMPv4Conn{
+		layerStates: []layerState{etherState, ipv4State, icmpState},
+		injector:    injector,
+		sniffer:     sniffer,
+		t:           t,
+	}
+}
+
+// Send a packet with reasonable defaults, potentially overriding the ICMPv4
+// layer with the provided layer.
+func (conn *ICMPv4Conn) Send(icmp ICMPv4, additionalLayers ...Layer) {
+	(*Connection)(conn).Send(&icmp, additionalLayers...)
+}
+
+// Expect a frame with the ICMPv4 layer matching the provided ICMPv4 within
+// the timeout specified. If it doesn't arrive in time, it returns nil.
+func (conn *ICMPv4Conn) Expect(icmp ICMPv4, timeout time.Duration) (*ICMPv4, error) {
+	layer, err := (*Connection)(conn).Expect(&icmp, timeout)
+	if layer == nil {
+		return nil, err
+	}
+	gotICMP, ok := layer.(*ICMPv4)
+	if !ok {
+		conn.t.Fatalf("expected %s to be ICMPv4", layer)
+	}
+	return gotICMP, err
+}
+
+// Ping sends an echo request with payload and waits up to timeout for the
+// matching echo reply, verified by id and sequence number.
+func (conn *ICMPv4Conn) Ping(payload []byte, timeout time.Duration) (*ICMPv4, error) {
+	conn.layerStates[len(conn.layerStates)-1].(*icmpv4State).nextSequence()
+	icmpType := header.ICMPv4Echo
+	conn.Send(ICMPv4{Type: &icmpType}, &Payload{Bytes: payload})
+	replyType := header.ICMPv4EchoReply
+	return conn.Expect(ICMPv4{Type: &replyType}, timeout)
+}
+
+// SendDestinationUnreachable sends an ICMPv4 Destination Unreachable message
+// of the given code, quoting originalFrame, to exercise the DUT's handling of
+// that error.
+func (conn *ICMPv4Conn) SendDestinationUnreachable(code uint8, originalFrame Layers) {
+	icmpType := header.ICMPv4DstUnreachable
+	payload, err := originalFrame.toBytes()
+	if err != nil {
+		conn.t.Fatalf("can't build original frame for Destination Unreachable: %s", err)
+	}
+	conn.Send(ICMPv4{Type: &icmpType, Code: Uint8(code)}, &Payload{Bytes: payload})
+}
+
+// SendTimeExceeded sends an ICMPv4 Time Exceeded message of the given code,
+// quoting originalFrame, to exercise the DUT's PMTUD/TTL-expiry handling.
+func (conn *ICMPv4Conn) SendTimeExceeded(code uint8, originalFrame Layers) {
+	icmpType := header.ICMPv4TimeExceeded
+	payload, err := originalFrame.toBytes()
+	if err != nil {
+		conn.t.Fatalf("can't build original frame for Time Exceeded: %s", err)
+	}
+	conn.Send(ICMPv4{Type: &icmpType, Code: Uint8(code)}, &Payload{Bytes: payload})
+}
+
+// Close cleans up any resources held.
+func (conn *ICMPv4Conn) Close() {
+	(*Connection)(conn).Close()
+}
+
+// ICMPv6Conn maintains the state for all the layers in an ICMPv6 flow over
+// IPv6.
+type ICMPv6Conn Connection
+
+// NewICMPv6 creates a new ICMPv6Conn connection with reasonable defaults.
+func NewICMPv6(t *testing.T, outgoing, incoming ICMPv6) ICMPv6Conn {
+	etherState, err := newEtherState(Ether{}, Ether{})
+	if err != nil {
+		t.Fatalf("can't make etherState: %s", err)
+	}
+	ipv6State, err := newIPv6State(IPv6{}, IPv6{})
+	if err != nil {
+		t.Fatalf("can't make ipv6State: %s", err)
+	}
+	icmpState, err := newICMPv6State(outgoing, incoming)
+	if err != nil {
+		t.Fatalf("can't make icmpv6State: %s", err)
+	}
+	injector, err := NewInjector(t)
+	if err != nil {
+		t.Fatalf("can't make injector: %s", err)
+	}
+	sniffer, err := NewSniffer(t)
+	if err != nil {
+		t.Fatalf("can't make sniffer: %s", err)
+	}
+
+	return ICMPv6Conn{
+		layerStates: []layerState{etherState, ipv6State, icmpState},
+		injector:    injector,
+		sniffer:     sniffer,
+		t:           t,
+	}
+}
+
+// Send a packet with reasonable defaults, potentially overriding the ICMPv6
+// layer with the provided layer.
+func (conn *ICMPv6Conn) Send(icmp ICMPv6, additionalLayers ...Layer) {
+	(*Connection)(conn).Send(&icmp, additionalLayers...)
+}
+
+// Expect a frame with the ICMPv6 layer matching the provided ICMPv6 within
+// the timeout specified. If it doesn't arrive in time, it returns nil.
+func (conn *ICMPv6Conn) Expect(icmp ICMPv6, timeout time.Duration) (*ICMPv6, error) {
+	layer, err := (*Connection)(conn).Expect(&icmp, timeout)
+	if layer == nil {
+		return nil, err
+	}
+	gotICMP, ok := layer.(*ICMPv6)
+	if !ok {
+		conn.t.Fatalf("expected %s to be ICMPv6", layer)
+	}
+	return gotICMP, err
+}
+
+// Ping sends an echo request with payload and waits up to timeout for the
+// matching echo reply, verified by id and sequence number.
+func (conn *ICMPv6Conn) Ping(payload []byte, timeout time.Duration) (*ICMPv6, error) {
+	conn.layerStates[len(conn.layerStates)-1].(*icmpv6State).nextSequence()
+	icmpType := header.ICMPv6EchoRequest
+	conn.Send(ICMPv6{Type: &icmpType}, &Payload{Bytes: payload})
+	replyType := header.ICMPv6EchoReply
+	return conn.Expect(ICMPv6{Type: &replyType}, timeout)
+}
+
+// SendPacketTooBig sends an ICMPv6 Packet Too Big message advertising mtu,
+// quoting originalFrame, to exercise the DUT's PMTUD path.
+func (conn *ICMPv6Conn) SendPacketTooBig(mtu uint32, originalFrame Layers) {
+	icmpType := header.ICMPv6PacketTooBig
+	payload, err := originalFrame.toBytes()
+	if err != nil {
+		conn.t.Fatalf("can't build original frame for Packet Too Big: %s", err)
+	}
+	conn.Send(ICMPv6{Type: &icmpType, MTU: Uint32(mtu)}, &Payload{Bytes: payload})
+}
+
+// Close cleans up any resources held.
+func (conn *ICMPv6Conn) Close() {
+	(*Connection)(conn).Close()
+}
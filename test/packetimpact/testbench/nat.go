@@ -0,0 +1,376 @@
+// Copyright 2020 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package testbench
+
+import (
+	"sync"
+	"time"
+
+	"github.com/mohae/deepcopy"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+)
+
+// Middlebox can rewrite a frame's Layers as it crosses the path between the
+// testbench and the DUT. Install one with Connection.AddMiddlebox to emulate
+// a network element, such as a NAT, sitting in between.
+type Middlebox interface {
+	// Outbound rewrites a frame about to be sent to the DUT. A nil result
+	// drops the frame.
+	Outbound(Layers) Layers
+	// Inbound rewrites a frame received from the DUT. A nil result drops the
+	// frame, as though it never arrived.
+	Inbound(Layers) Layers
+}
+
+// NATBehavior selects how a NAT maps internal flows to external ports and
+// filters inbound traffic back to them, following the terminology of
+// RFC 4787.
+type NATBehavior int
+
+const (
+	// EndpointIndependent maps/filters by the internal flow alone: any
+	// external host or port may reach a mapped flow.
+	EndpointIndependent NATBehavior = iota
+	// AddressDependent maps/filters additionally by the external address.
+	AddressDependent
+	// AddressAndPortDependent (i.e. "Symmetric") maps/filters by the full
+	// external address and port: a distinct mapping is created per external
+	// peer the internal flow talks to.
+	AddressAndPortDependent
+)
+
+// natFlow is one internal<->external port mapping.
+type natFlow struct {
+	internal    fiveTuple
+	externalKey natKey
+	lastUsed    time.Time
+}
+
+// fiveTuple identifies a flow as seen from the internal (testbench) side.
+type fiveTuple struct {
+	proto   tcpip.TransportProtocolNumber
+	srcAddr tcpip.Address
+	srcPort uint16
+	dstAddr tcpip.Address
+	dstPort uint16
+}
+
+// natKey identifies an externally-visible mapping. Which fields of the
+// internal flow participate in the key is determined by a NATBehavior.
+type natKey struct {
+	proto    tcpip.TransportProtocolNumber
+	extPort  uint16
+	peerAddr tcpip.Address // zero unless AddressDependent or stricter
+	peerPort uint16        // zero unless AddressAndPortDependent
+}
+
+// NAT is a Middlebox that emulates a NAT sitting in front of the testbench,
+// rewriting the internal address/port to externalAddr and a mapped port, and
+// filtering unsolicited inbound flows per the configured NATBehavior. See
+// natlab/vnet in Tailscale's codebase for the model this follows.
+type NAT struct {
+	// Mapping selects which fields of an inbound frame must match a mapping
+	// for the mapping to be found: the external port alone, plus the peer
+	// address, or plus the peer port too. It does not affect port
+	// allocation: each distinct internal 5-tuple gets its own external port,
+	// so a port is not shared across peers under any Mapping.
+	Mapping NATBehavior
+	// Filtering selects which external peers are allowed to reach a mapped
+	// flow once it exists. It is checked after the Mapping lookup, so it can
+	// only narrow what Mapping admits.
+	Filtering NATBehavior
+	// ExternalAddr is the address the NAT appears to have from the DUT's
+	// point of view.
+	ExternalAddr tcpip.Address
+	// PreservePort, if true, tries to map an internal port to the same
+	// external port number before falling back to allocation.
+	PreservePort bool
+	// IdleTimeout is how long a mapping survives without traffic before it's
+	// torn down. Zero means mappings never expire.
+	IdleTimeout time.Duration
+
+	mu         sync.Mutex
+	nextPort   uint16
+	byInternal map[fiveTuple]*natFlow
+	byExternal map[natKey]*natFlow
+}
+
+// NewNAT creates a NAT with the given mapping and filtering behavior and
+// reasonable defaults for everything else.
+func NewNAT(mapping, filtering NATBehavior) *NAT {
+	return &NAT{
+		Mapping:    mapping,
+		Filtering:  filtering,
+		nextPort:   1024,
+		byInternal: make(map[fiveTuple]*natFlow),
+		byExternal: make(map[natKey]*natFlow),
+	}
+}
+
+// mappingKey is the subset of a flow's external key that participates in the
+// mapping decision for the given NATBehavior.
+func mappingKey(behavior NATBehavior, proto tcpip.TransportProtocolNumber, extPort uint16, peerAddr tcpip.Address, peerPort uint16) natKey {
+	k := natKey{proto: proto, extPort: extPort}
+	switch behavior {
+	case AddressDependent:
+		k.peerAddr = peerAddr
+	case AddressAndPortDependent:
+		k.peerAddr = peerAddr
+		k.peerPort = peerPort
+	}
+	return k
+}
+
+// flowFor returns the natFlow for internal, creating and mapping a fresh
+// external port if this is the first time internal has been seen.
+func (n *NAT) flowFor(internal fiveTuple) *natFlow {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.expireLocked()
+
+	if f, ok := n.byInternal[internal]; ok {
+		f.lastUsed = time.Now()
+		return f
+	}
+
+	extPort := internal.srcPort
+	if !n.PreservePort || n.portTaken(extPort) {
+		extPort = n.allocatePort()
+	}
+	f := &natFlow{
+		internal:    internal,
+		externalKey: mappingKey(n.Mapping, internal.proto, extPort, internal.dstAddr, internal.dstPort),
+		lastUsed:    time.Now(),
+	}
+	n.byInternal[internal] = f
+	n.byExternal[f.externalKey] = f
+	return f
+}
+
+func (n *NAT) portTaken(port uint16) bool {
+	for key := range n.byExternal {
+		if key.extPort == port {
+			return true
+		}
+	}
+	return false
+}
+
+func (n *NAT) allocatePort() uint16 {
+	for n.portTaken(n.nextPort) {
+		n.nextPort++
+	}
+	port := n.nextPort
+	n.nextPort++
+	return port
+}
+
+// Outbound rewrites the source address/port of an internal flow to its
+// mapped external address/port.
+func (n *NAT) Outbound(frame Layers) Layers {
+	ip, transport, ok := natEndpoints(frame)
+	if !ok {
+		return frame
+	}
+	internal := fiveTuple{
+		proto:   transport.proto,
+		srcAddr: ip.src,
+		srcPort: transport.srcPort,
+		dstAddr: ip.dst,
+		dstPort: transport.dstPort,
+	}
+	flow := n.flowFor(internal)
+	frame = cloneLayers(frame)
+	rewriteSource(frame, n.ExternalAddr, flow.externalKey.extPort)
+	return frame
+}
+
+// Inbound rewrites the destination address/port of a frame addressed to the
+// NAT's external mapping back to the internal flow, or drops the frame if no
+// mapping admits it per the configured filtering behavior.
+func (n *NAT) Inbound(frame Layers) Layers {
+	ip, transport, ok := natEndpoints(frame)
+	if !ok {
+		return frame
+	}
+
+	n.mu.Lock()
+	n.expireLocked()
+	// Look the flow up by the mapping behavior's key: that's how it was
+	// stored in flowFor, regardless of how strict Filtering is.
+	mapKey := mappingKey(n.Mapping, transport.proto, transport.dstPort, ip.src, transport.srcPort)
+	f, ok := n.byExternal[mapKey]
+	if ok {
+		// Filtering is then enforced separately, by checking the actual peer
+		// against the flow's own recorded destination, since Filtering may be
+		// stricter than Mapping (e.g. EndpointIndependent mapping with
+		// AddressAndPortDependent filtering, the common "port-restricted
+		// cone" NAT).
+		switch n.Filtering {
+		case AddressDependent:
+			ok = ip.src == f.internal.dstAddr
+		case AddressAndPortDependent:
+			ok = ip.src == f.internal.dstAddr && transport.srcPort == f.internal.dstPort
+		}
+	}
+	if ok {
+		f.lastUsed = time.Now()
+	}
+	n.mu.Unlock()
+
+	if !ok {
+		return nil // Filtered: no mapping admits this peer.
+	}
+	rewriteDestination(frame, f.internal.srcAddr, f.internal.srcPort)
+	return frame
+}
+
+// expireLocked removes mappings idle for longer than n.IdleTimeout. n.mu must
+// be held.
+func (n *NAT) expireLocked() {
+	if n.IdleTimeout == 0 {
+		return
+	}
+	cutoff := time.Now().Add(-n.IdleTimeout)
+	for internal, f := range n.byInternal {
+		if f.lastUsed.Before(cutoff) {
+			delete(n.byInternal, internal)
+			delete(n.byExternal, f.externalKey)
+		}
+	}
+}
+
+// natIPEndpoints are the addresses pulled off whichever IP layer is present.
+type natIPEndpoints struct {
+	src, dst tcpip.Address
+}
+
+// natTransportEndpoints are the ports and protocol pulled off whichever
+// transport layer is present.
+type natTransportEndpoints struct {
+	proto            tcpip.TransportProtocolNumber
+	srcPort, dstPort uint16
+}
+
+// natEndpoints extracts the IP and transport 5-tuple fields from frame. It
+// returns ok=false for frames without both an IP and a TCP/UDP layer (e.g. a
+// bare ARP or ICMP frame), which NAT passes through untouched.
+func natEndpoints(frame Layers) (natIPEndpoints, natTransportEndpoints, bool) {
+	var ip natIPEndpoints
+	haveIP := false
+	for _, l := range frame {
+		switch v := l.(type) {
+		case *IPv4:
+			if v.SrcAddr != nil {
+				ip.src = *v.SrcAddr
+			}
+			if v.DstAddr != nil {
+				ip.dst = *v.DstAddr
+			}
+			haveIP = true
+		case *IPv6:
+			if v.SrcAddr != nil {
+				ip.src = *v.SrcAddr
+			}
+			if v.DstAddr != nil {
+				ip.dst = *v.DstAddr
+			}
+			haveIP = true
+		}
+	}
+	if !haveIP {
+		return ip, natTransportEndpoints{}, false
+	}
+
+	for _, l := range frame {
+		switch v := l.(type) {
+		case *TCP:
+			t := natTransportEndpoints{proto: header.TCPProtocolNumber}
+			if v.SrcPort != nil {
+				t.srcPort = *v.SrcPort
+			}
+			if v.DstPort != nil {
+				t.dstPort = *v.DstPort
+			}
+			return ip, t, true
+		case *UDP:
+			t := natTransportEndpoints{proto: header.UDPProtocolNumber}
+			if v.SrcPort != nil {
+				t.srcPort = *v.SrcPort
+			}
+			if v.DstPort != nil {
+				t.dstPort = *v.DstPort
+			}
+			return ip, t, true
+		}
+	}
+	return ip, natTransportEndpoints{}, false
+}
+
+// cloneLayers deep-copies every Layer in frame. Some layerStates (all but
+// tcpState) hand SendFrame the live out template via outgoing(), so NAT must
+// rewrite a copy rather than mutate it in place; otherwise the mapped
+// external port/address would stick to the connection's own state and look
+// like a brand new flow on the next SendFrame.
+func cloneLayers(frame Layers) Layers {
+	out := make(Layers, len(frame))
+	for i, l := range frame {
+		out[i] = deepcopy.Copy(l).(Layer)
+	}
+	return out
+}
+
+// rewriteSource overwrites the source address/port of frame's IP and
+// transport layers in place. Checksums are left unset so toBytes recomputes
+// them from the rewritten fields.
+func rewriteSource(frame Layers, addr tcpip.Address, port uint16) {
+	for _, l := range frame {
+		switch v := l.(type) {
+		case *IPv4:
+			v.SrcAddr = &addr
+			v.Checksum = nil
+		case *IPv6:
+			v.SrcAddr = &addr
+		case *TCP:
+			v.SrcPort = &port
+			v.Checksum = nil
+		case *UDP:
+			v.SrcPort = &port
+			v.Checksum = nil
+		}
+	}
+}
+
+// rewriteDestination overwrites the destination address/port of frame's IP
+// and transport layers in place. Checksums are left unset so toBytes
+// recomputes them from the rewritten fields.
+func rewriteDestination(frame Layers, addr tcpip.Address, port uint16) {
+	for _, l := range frame {
+		switch v := l.(type) {
+		case *IPv4:
+			v.DstAddr = &addr
+			v.Checksum = nil
+		case *IPv6:
+			v.DstAddr = &addr
+		case *TCP:
+			v.DstPort = &port
+			v.Checksum = nil
+		case *UDP:
+			v.DstPort = &port
+			v.Checksum = nil
+		}
+	}
+}
@@ -0,0 +1,122 @@
+// Copyright 2020 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package testbench
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+)
+
+var pcapDir = flag.String("testbench_pcap", "", "if set, write a PCAP-NG capture of every frame sent and received by each test to this directory")
+
+// Direction-distinguishing interface IDs used in the capture: every outgoing
+// frame is recorded on pcapOutInterface and every incoming frame on
+// pcapInInterface, so the direction survives export to tools like Wireshark
+// without relying on a per-packet flag.
+const (
+	pcapOutInterface = 0
+	pcapInInterface  = 1
+)
+
+// pcapWriter persists every frame sent and received over a Connection to a
+// PCAP-NG file, so that a failing ExpectFrame diff can be root-caused by
+// opening the capture. A nil *pcapWriter is valid and a no-op, so callers
+// don't need to guard every call against -testbench_pcap being unset.
+type pcapWriter struct {
+	f *os.File
+	w *pcapgo.NgWriter
+}
+
+// newPCAPWriter creates a pcapWriter that records to
+// <-testbench_pcap>/<testName>.pcapng. It returns a nil *pcapWriter, with no
+// error, if -testbench_pcap was not set.
+func newPCAPWriter(testName string) (*pcapWriter, error) {
+	if *pcapDir == "" {
+		return nil, nil
+	}
+	if err := os.MkdirAll(*pcapDir, 0755); err != nil {
+		return nil, fmt.Errorf("can't create pcap directory %q: %w", *pcapDir, err)
+	}
+	name := strings.NewReplacer("/", "_").Replace(testName)
+	f, err := os.Create(filepath.Join(*pcapDir, name+".pcapng"))
+	if err != nil {
+		return nil, fmt.Errorf("can't create pcap file: %w", err)
+	}
+	w, err := pcapgo.NewNgWriterInterface(f, pcapgo.NgInterface{
+		Name:       "out",
+		LinkType:   layers.LinkTypeEthernet,
+		SnapLength: 65535,
+	}, pcapgo.NgWriterOptions{})
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("can't create pcapng writer: %w", err)
+	}
+	if _, err := w.AddInterface(pcapgo.NgInterface{
+		Name:       "in",
+		LinkType:   layers.LinkTypeEthernet,
+		SnapLength: 65535,
+	}); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("can't add pcapng interface: %w", err)
+	}
+	return &pcapWriter{f: f, w: w}, nil
+}
+
+// writeOutbound records a frame that was injected onto the wire.
+func (p *pcapWriter) writeOutbound(b []byte) {
+	p.write(b, pcapOutInterface)
+}
+
+// writeInbound records a frame that was sniffed off the wire.
+func (p *pcapWriter) writeInbound(b []byte) {
+	p.write(b, pcapInInterface)
+}
+
+func (p *pcapWriter) write(b []byte, iface int) {
+	if p == nil {
+		return
+	}
+	ci := gopacket.CaptureInfo{
+		Timestamp:      time.Now(),
+		CaptureLength:  len(b),
+		Length:         len(b),
+		InterfaceIndex: iface,
+	}
+	if err := p.w.WritePacket(ci, b); err != nil {
+		// A capture failure shouldn't fail the test that's driving it.
+		fmt.Fprintf(os.Stderr, "pcapWriter: failed to write packet: %s\n", err)
+	}
+}
+
+// Close flushes and closes the underlying capture file. It is a no-op on a
+// nil *pcapWriter.
+func (p *pcapWriter) Close() error {
+	if p == nil {
+		return nil
+	}
+	if err := p.w.Flush(); err != nil {
+		p.f.Close()
+		return fmt.Errorf("can't flush pcap capture: %w", err)
+	}
+	return p.f.Close()
+}